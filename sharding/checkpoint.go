@@ -0,0 +1,373 @@
+package sharding
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// CheckpointFormatVersion is bumped whenever the encoded shape of Checkpoint
+// changes. JSONFileCheckpointStore.Load refuses a checkpoint whose version
+// is newer than the one it understands.
+const CheckpointFormatVersion = 1
+
+// Stage identifies where in the ShardingFerry pipeline a checkpoint was
+// taken.
+type Stage int
+
+const (
+	StageRowCopy Stage = iota
+	StagePreVerify
+	StageCutover
+	StagePKCopy
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageRowCopy:
+		return "RowCopy"
+	case StagePreVerify:
+		return "PreVerify"
+	case StageCutover:
+		return "Cutover"
+	case StagePKCopy:
+		return "PKCopy"
+	default:
+		return "Unknown"
+	}
+}
+
+// TableProgress records how far row-copy has gotten for a single table, in
+// terms of the last primary key value handed off to a CursorConfig.
+type TableProgress struct {
+	TableName string
+	LastPK    uint64
+	Done      bool
+}
+
+// Checkpoint is a versioned, point-in-time snapshot of everything Resume
+// needs to pick a ShardingFerry run back up without redoing completed work.
+type Checkpoint struct {
+	Version int
+	Stage   Stage
+
+	BinlogFile     string
+	BinlogPosition uint32
+	BinlogGTIDSet  string
+
+	TableProgress map[string]*TableProgress
+	ReverifyQueue []ghostferryReverifyEntry
+
+	PrimaryKeyTables []string
+}
+
+// ghostferryReverifyEntry mirrors ghostferry.ReverifyEntry's Table/PK pair,
+// which IterativeVerifier.ReverifyEntries/QueueReverify use. It is
+// duplicated here, rather than imported, so that Checkpoint's gob encoding
+// does not depend on the internal layout of the verifier's own queue type.
+type ghostferryReverifyEntry struct {
+	TableName string
+	PK        uint64
+}
+
+// CheckpointStore persists and retrieves the single most recent Checkpoint
+// for a ShardingFerry run. Implementations must make Save durable before
+// returning, since a crash immediately after Save is exactly the case this
+// subsystem exists to survive.
+type CheckpointStore interface {
+	Save(checkpoint *Checkpoint) error
+	Load() (*Checkpoint, error)
+}
+
+// JSONFileCheckpointStore is the default CheckpointStore. It keeps a single
+// checkpoint file on disk and overwrites it atomically via a rename so a
+// killed process never leaves behind a half-written file. Despite its name,
+// the file holds the checkpoint encoded with encoding/gob, not JSON.
+type JSONFileCheckpointStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func NewJSONFileCheckpointStore(path string) *JSONFileCheckpointStore {
+	return &JSONFileCheckpointStore{Path: path}
+}
+
+func (s *JSONFileCheckpointStore) Save(checkpoint *Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(checkpoint); err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), ".checkpoint-*")
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync checkpoint: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close checkpoint temp file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("failed to commit checkpoint: %v", err)
+	}
+
+	return nil
+}
+
+func (s *JSONFileCheckpointStore) Load() (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+
+	checkpoint := &Checkpoint{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint: %v", err)
+	}
+
+	if checkpoint.Version > CheckpointFormatVersion {
+		return nil, fmt.Errorf("checkpoint version %d is newer than this binary understands (%d)", checkpoint.Version, CheckpointFormatVersion)
+	}
+
+	return checkpoint, nil
+}
+
+// checkpointInterval is how often ShardingFerry snapshots its progress while
+// a CheckpointStore is attached.
+const checkpointInterval = 30 * time.Second
+
+// startCheckpointing launches the background snapshot loop and returns a
+// function that stops it. It is a no-op when no CheckpointStore is attached.
+func (r *ShardingFerry) startCheckpointing() func() {
+	if r.checkpointStore == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(checkpointInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.saveCheckpoint(r.currentStage()); err != nil {
+					r.logger.WithField("error", err).Error("failed to save checkpoint")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (r *ShardingFerry) currentStage() Stage {
+	r.stageMu.Lock()
+	defer r.stageMu.Unlock()
+	return r.stage
+}
+
+func (r *ShardingFerry) setStage(stage Stage) {
+	r.stageMu.Lock()
+	r.stage = stage
+	r.stageMu.Unlock()
+
+	// Save a checkpoint immediately on every stage transition rather than
+	// waiting for the next checkpointInterval tick, so a process killed
+	// shortly after entering a stage still leaves behind a checkpoint for
+	// that stage instead of none at all.
+	if r.checkpointStore != nil {
+		if err := r.saveCheckpoint(stage); err != nil {
+			r.logger.WithField("error", err).Error("failed to save checkpoint on stage entry")
+		}
+	}
+}
+
+func (r *ShardingFerry) saveCheckpoint(stage Stage) error {
+	pos := r.Ferry.BinlogStreamer.GetLastStreamedBinlogPosition()
+
+	gtidSet, err := r.currentGTIDSet()
+	if err != nil {
+		// A checkpoint without a GTID set is still useful (verifyResumeGTID
+		// falls back to comparing BinlogFile/BinlogPosition), so a failure to
+		// read gtid_executed is logged rather than aborting the checkpoint.
+		r.logger.WithField("error", err).Warn("failed to read source GTID set for checkpoint")
+	}
+
+	pkTables := make([]string, 0, len(r.config.PrimaryKeyTables))
+	pkTables = append(pkTables, r.config.PrimaryKeyTables...)
+
+	tableProgress := map[string]*TableProgress{}
+	for table, progress := range r.Ferry.Progress().Tables {
+		tableProgress[table] = &TableProgress{
+			TableName: table,
+			LastPK:    progress.LastSuccessfulPrimaryKey,
+			Done:      progress.CurrentAction == "wait-for-delta" || progress.CurrentAction == "complete",
+		}
+	}
+
+	checkpoint := &Checkpoint{
+		Version:          CheckpointFormatVersion,
+		Stage:            stage,
+		BinlogFile:       pos.Name,
+		BinlogPosition:   pos.Pos,
+		BinlogGTIDSet:    gtidSet,
+		TableProgress:    tableProgress,
+		ReverifyQueue:    r.reverifyQueue(),
+		PrimaryKeyTables: pkTables,
+	}
+
+	return r.checkpointStore.Save(checkpoint)
+}
+
+// currentGTIDSet reads the source's executed GTID set, which
+// verifyResumeGTID later uses to prove a checkpointed position is still
+// covered by the source's retained binlog even across a file rotation.
+func (r *ShardingFerry) currentGTIDSet() (string, error) {
+	var gtidSet string
+	err := r.Ferry.SourceDB.QueryRow("SELECT @@GLOBAL.gtid_executed").Scan(&gtidSet)
+	if err != nil {
+		return "", fmt.Errorf("failed to read source gtid_executed: %v", err)
+	}
+	return gtidSet, nil
+}
+
+// reverifyQueue snapshots the IterativeVerifier's pending reverifications so
+// a resumed run does not drop rows that were queued for a second look but
+// not yet reverified when the checkpoint was taken.
+func (r *ShardingFerry) reverifyQueue() []ghostferryReverifyEntry {
+	if r.verifier == nil {
+		return nil
+	}
+
+	entries := r.verifier.ReverifyEntries()
+	queue := make([]ghostferryReverifyEntry, 0, len(entries))
+	for _, entry := range entries {
+		queue = append(queue, ghostferryReverifyEntry{TableName: entry.Table, PK: entry.PK})
+	}
+	return queue
+}
+
+// Resume loads the last checkpoint into r, so that the following
+// Start/Run re-queues its pending reverifications, skips the pre-cutover
+// verification and cutover stages the checkpoint had already passed, and
+// has the joined-table delta copy and primary-key-table copy skip the tables
+// and row ranges the checkpoint recorded as copied. The row copy that
+// Ferry.Run performs at the start of Run is not narrowed by the checkpoint.
+// Resume returns an error, rather than falling back to a fresh run, if no
+// checkpoint exists or, for a checkpoint taken at the Cutover stage or
+// later, the checkpointed binlog position no longer matches what the source
+// has retained; a mismatched restart against a purged binlog cannot be made
+// safe and must be treated as an operator decision, not a silent restart.
+func (r *ShardingFerry) Resume() error {
+	if r.checkpointStore == nil {
+		return fmt.Errorf("no checkpoint store configured, cannot resume")
+	}
+
+	checkpoint, err := r.checkpointStore.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoint: %v", err)
+	}
+	if checkpoint == nil {
+		return fmt.Errorf("no checkpoint found to resume from")
+	}
+
+	if checkpoint.Stage >= StageCutover {
+		if err := r.verifyResumeGTID(checkpoint); err != nil {
+			return fmt.Errorf("refusing to resume from mismatched binlog position: %v", err)
+		}
+	}
+
+	r.config.PrimaryKeyTables = checkpoint.PrimaryKeyTables
+	// The stage is set directly rather than via setStage: the store already
+	// holds this checkpoint, and saving a new one needs the source connection
+	// and binlog streamer, which Resume runs before Initialize/Start set up.
+	r.stageMu.Lock()
+	r.stage = checkpoint.Stage
+	r.stageMu.Unlock()
+	r.resumeFrom = checkpoint
+
+	return nil
+}
+
+// verifyResumeGTID confirms that the checkpointed position is still provably
+// covered by the source's retained binlog, so Resume never silently replays
+// or skips a window of writes. Whenever the checkpoint carries a GTID set,
+// that is the authoritative check: the source's current executed GTID set
+// must contain it, which holds even across a binlog file rotation or purge.
+// The file/position comparison is only a fallback for a source that had
+// GTIDs disabled when the checkpoint was taken, and in that degraded mode a
+// rotated binlog file can never be proven safe, so it is rejected outright.
+func (r *ShardingFerry) verifyResumeGTID(checkpoint *Checkpoint) error {
+	pos := r.Ferry.BinlogStreamer.GetLastStreamedBinlogPosition()
+	if pos.Name == "" {
+		return fmt.Errorf("source binlog streamer has no current position")
+	}
+
+	if checkpoint.BinlogGTIDSet != "" {
+		checkpointedSet, err := mysql.ParseMysqlGTIDSet(checkpoint.BinlogGTIDSet)
+		if err != nil {
+			return fmt.Errorf("failed to parse checkpointed GTID set %q: %v", checkpoint.BinlogGTIDSet, err)
+		}
+
+		currentSetStr, err := r.currentGTIDSet()
+		if err != nil {
+			return fmt.Errorf("failed to read current source GTID set: %v", err)
+		}
+
+		currentSet, err := mysql.ParseMysqlGTIDSet(currentSetStr)
+		if err != nil {
+			return fmt.Errorf("failed to parse current source GTID set %q: %v", currentSetStr, err)
+		}
+
+		if !currentSet.Contain(checkpointedSet) {
+			return fmt.Errorf("checkpointed GTID set %q is not contained in the source's current GTID set %q; the source's binlog no longer covers it", checkpoint.BinlogGTIDSet, currentSetStr)
+		}
+
+		return nil
+	}
+
+	if checkpoint.BinlogFile != pos.Name {
+		return fmt.Errorf("checkpointed binlog file %s has rotated (source is now on %s); cannot prove the checkpoint is still covered without a GTID set", checkpoint.BinlogFile, pos.Name)
+	}
+
+	if checkpoint.BinlogPosition > pos.Pos {
+		return fmt.Errorf("checkpointed position %s:%d is ahead of current source position %s:%d", checkpoint.BinlogFile, checkpoint.BinlogPosition, pos.Name, pos.Pos)
+	}
+
+	return nil
+}
@@ -0,0 +1,264 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LeaseHandle identifies a lease held with a CutoverCoordinator. Token is a
+// fencing token: for coordinators that hold a real lease it increases
+// monotonically with every successful Lock (Renew keeps the token of the
+// lease it renews), and must be threaded into any write performed during the cutover
+// window so that a ferry which has lost its lease cannot silently corrupt
+// the target with a write the coordinator no longer believes it is allowed
+// to make.
+type LeaseHandle struct {
+	ID    string
+	Token uint64
+}
+
+// CutoverCoordinatorMeta describes the run taking the lease, for
+// coordinators that want to record who holds it.
+type CutoverCoordinatorMeta struct {
+	RunID   string
+	Tenants []interface{}
+}
+
+// CutoverCoordinator replaces a bare HTTP callback with a real distributed
+// lock: a lease that must be renewed to stay valid, and that carries a
+// fencing token so a ferry which falls behind on renewal cannot keep acting
+// as if it still holds the lock.
+type CutoverCoordinator interface {
+	Lock(ctx context.Context, meta CutoverCoordinatorMeta) (LeaseHandle, error)
+	Renew(ctx context.Context, lease LeaseHandle) (LeaseHandle, error)
+	Unlock(ctx context.Context, lease LeaseHandle) error
+}
+
+// HTTPCutoverCoordinator adapts the original CutoverLock/CutoverUnlock HTTP
+// callbacks to the CutoverCoordinator interface. It has no real lease
+// semantics: a successful Lock always returns the same fixed token and Renew
+// always succeeds with the lease unchanged, matching the
+// trust-the-single-endpoint behavior the rest of this package had before
+// CutoverCoordinator existed. Both callbacks retry transient failures with
+// exponential backoff; Unlock retries more aggressively than Lock, since
+// leaving the app locked is worse than a slow lock acquisition.
+type HTTPCutoverCoordinator struct {
+	Lock_   CutoverCallback
+	Unlock_ CutoverCallback
+	Client  *http.Client
+
+	LockRetry   *RetryConfig
+	UnlockRetry *RetryConfig
+}
+
+func (c *HTTPCutoverCoordinator) Lock(ctx context.Context, meta CutoverCoordinatorMeta) (LeaseHandle, error) {
+	client := c.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	err := retryCutoverCallback(client, c.Lock_, meta.RunID, "lock", meta.Tenants, c.LockRetry, func(attempt int) {
+		metrics.Count("CutoverLockRetries", 1, nil, 1.0)
+	})
+	if err != nil {
+		return LeaseHandle{}, err
+	}
+
+	return LeaseHandle{ID: meta.RunID, Token: 1}, nil
+}
+
+func (c *HTTPCutoverCoordinator) Renew(ctx context.Context, lease LeaseHandle) (LeaseHandle, error) {
+	return lease, nil
+}
+
+func (c *HTTPCutoverCoordinator) Unlock(ctx context.Context, lease LeaseHandle) error {
+	client := c.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	unlockRetry := c.UnlockRetry
+	if unlockRetry == nil {
+		unlockRetry = defaultUnlockRetryConfig()
+	}
+
+	attempts := 0
+	err := retryCutoverCallback(client, c.Unlock_, lease.ID, "unlock", nil, unlockRetry, func(attempt int) {
+		attempts = attempt
+		metrics.Count("CutoverUnlockRetries", 1, nil, 1.0)
+	})
+	if err != nil && unlockRetry.withDefaults().IsRetryable(err) {
+		return &CutoverUnlockAbandoned{
+			IdempotencyKey: fmt.Sprintf("%s-unlock-%d", lease.ID, attempts+1),
+			LastErr:        err,
+		}
+	}
+
+	return err
+}
+
+// CutoverCoordinatorConfig controls lease behavior for distributed
+// CutoverCoordinator implementations (etcd, Consul, Redis). It has no
+// effect on HTTPCutoverCoordinator, which does not hold a real lease.
+type CutoverCoordinatorConfig struct {
+	// LeaseTTL is how long the coordinator's backing store will honor the
+	// lease without a renewal.
+	LeaseTTL time.Duration
+
+	// RenewalInterval is how often leaseRenewer's renewal goroutine calls Renew.
+	// It should be comfortably shorter than LeaseTTL.
+	RenewalInterval time.Duration
+}
+
+func (c *CutoverCoordinatorConfig) withDefaults() *CutoverCoordinatorConfig {
+	var cfg CutoverCoordinatorConfig
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.LeaseTTL == 0 {
+		cfg.LeaseTTL = 30 * time.Second
+	}
+	if cfg.RenewalInterval == 0 {
+		cfg.RenewalInterval = cfg.LeaseTTL / 3
+	}
+	return &cfg
+}
+
+// leaseRenewer runs a background goroutine that keeps a LeaseHandle fresh
+// for as long as the cutover window is open, fataling the run the moment
+// renewal stops succeeding rather than letting the run continue against a
+// lease it may no longer hold.
+type leaseRenewer struct {
+	coordinator CutoverCoordinator
+	config      *CutoverCoordinatorConfig
+	onFailure   func(error)
+
+	mu     sync.Mutex
+	lease  LeaseHandle
+	lost   bool
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newLeaseRenewer(coordinator CutoverCoordinator, config *CutoverCoordinatorConfig, onFailure func(error)) *leaseRenewer {
+	return &leaseRenewer{
+		coordinator: coordinator,
+		config:      config.withDefaults(),
+		onFailure:   onFailure,
+	}
+}
+
+// start begins auto-renewing lease in the background and returns a stop
+// function. ShardingFerry.Run and MultiTenantShardingFerry.Run call it once
+// the initial Lock has succeeded.
+func (r *leaseRenewer) start(lease LeaseHandle) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.lease = lease
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.mu.Unlock()
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.config.RenewalInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.mu.Lock()
+				current := r.lease
+				r.mu.Unlock()
+
+				renewCtx, renewCancel := context.WithTimeout(ctx, r.config.RenewalInterval)
+				renewed, err := r.coordinator.Renew(renewCtx, current)
+				renewCancel()
+
+				if err != nil {
+					r.mu.Lock()
+					r.lost = true
+					r.mu.Unlock()
+					r.onFailure(fmt.Errorf("failed to renew cutover lease: %v", err))
+					return
+				}
+
+				r.mu.Lock()
+				r.lease = renewed
+				r.mu.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-r.done
+	}
+}
+
+func (r *leaseRenewer) currentLease() LeaseHandle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lease
+}
+
+// isLost reports whether the most recent renewal attempt failed. Once true,
+// the lease must be treated as no longer held, regardless of how much time
+// is left on its nominal TTL.
+func (r *leaseRenewer) isLost() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lost
+}
+
+// fenceTableDDL creates the table claimFence uses to durably record the
+// highest fencing token any ferry run has claimed against a target, so that
+// a stale ferry whose in-memory lease state has not yet caught up to losing
+// its lease (the TOCTOU window assertLeaseHeld cannot close on its own)
+// still has its writes rejected by the target itself.
+const fenceTableDDL = `CREATE TABLE IF NOT EXISTS _ghostferry_cutover_fence (
+	run_id VARCHAR(255) PRIMARY KEY,
+	token BIGINT UNSIGNED NOT NULL
+)`
+
+// ensureFenceTable creates the fencing table on target if it does not
+// already exist. It is idempotent and meant to be called once per run,
+// right after a cutover lease is first acquired.
+func ensureFenceTable(ctx context.Context, target *sql.DB) error {
+	_, err := target.ExecContext(ctx, fenceTableDDL)
+	return err
+}
+
+// claimFence durably records token as the highest fencing token seen for
+// runID against target, and fails if a higher token has already been
+// claimed there. It must be called immediately before any write performed
+// during the cutover window, so that losing a lease is enforced by the
+// target database itself rather than only by the ferry's own belief that
+// it still holds the lease.
+func claimFence(ctx context.Context, target *sql.DB, runID string, token uint64) error {
+	_, err := target.ExecContext(ctx, `
+		INSERT INTO _ghostferry_cutover_fence (run_id, token) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE token = GREATEST(token, VALUES(token))
+	`, runID, token)
+	if err != nil {
+		return fmt.Errorf("failed to claim fencing token %d for %s: %v", token, runID, err)
+	}
+
+	var stored uint64
+	err = target.QueryRowContext(ctx, `SELECT token FROM _ghostferry_cutover_fence WHERE run_id = ?`, runID).Scan(&stored)
+	if err != nil {
+		return fmt.Errorf("failed to verify fencing token for %s: %v", runID, err)
+	}
+	if stored > token {
+		return fmt.Errorf("fencing token %d for %s has been superseded by %d, refusing to write", token, runID, stored)
+	}
+
+	return nil
+}
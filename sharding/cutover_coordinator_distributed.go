@@ -0,0 +1,263 @@
+package sharding
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hashicorp/consul/api"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// EtcdCutoverCoordinator takes a fenced lease on an etcd session-backed
+// lock, so that service-discovery-aware consumers can see which ferry run
+// currently owns the cutover window.
+type EtcdCutoverCoordinator struct {
+	Client  *clientv3.Client
+	LockKey string
+	Config  *CutoverCoordinatorConfig
+
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+}
+
+func NewEtcdCutoverCoordinator(client *clientv3.Client, lockKey string, config *CutoverCoordinatorConfig) *EtcdCutoverCoordinator {
+	return &EtcdCutoverCoordinator{Client: client, LockKey: lockKey, Config: config.withDefaults()}
+}
+
+func (c *EtcdCutoverCoordinator) Lock(ctx context.Context, meta CutoverCoordinatorMeta) (LeaseHandle, error) {
+	session, err := concurrency.NewSession(c.Client, concurrency.WithTTL(int(c.Config.LeaseTTL.Seconds())))
+	if err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to open etcd session: %v", err)
+	}
+
+	mutex := concurrency.NewMutex(session, c.LockKey)
+	if err := mutex.Lock(ctx); err != nil {
+		session.Close()
+		return LeaseHandle{}, fmt.Errorf("failed to acquire etcd lock %s: %v", c.LockKey, err)
+	}
+
+	c.session = session
+	c.mutex = mutex
+
+	// The cluster revision at which the lock was acquired only ever grows,
+	// so it serves as this acquisition's fencing token.
+	return LeaseHandle{ID: c.LockKey, Token: uint64(mutex.Header().Revision)}, nil
+}
+
+func (c *EtcdCutoverCoordinator) Renew(ctx context.Context, lease LeaseHandle) (LeaseHandle, error) {
+	if c.session == nil {
+		return LeaseHandle{}, fmt.Errorf("no active etcd session for lease %s", lease.ID)
+	}
+
+	// concurrency.Session keeps itself alive via a background keepalive
+	// goroutine; Renew here only needs to confirm it is still live.
+	select {
+	case <-c.session.Done():
+		return LeaseHandle{}, fmt.Errorf("etcd session for lease %s expired", lease.ID)
+	default:
+		return lease, nil
+	}
+}
+
+func (c *EtcdCutoverCoordinator) Unlock(ctx context.Context, lease LeaseHandle) error {
+	if c.mutex == nil {
+		return fmt.Errorf("no active etcd lock for lease %s", lease.ID)
+	}
+
+	if err := c.mutex.Unlock(ctx); err != nil {
+		return fmt.Errorf("failed to release etcd lock %s: %v", c.LockKey, err)
+	}
+
+	return c.session.Close()
+}
+
+// ConsulCutoverCoordinator takes a fenced session-backed lock against
+// Consul's KV store, registering the ferry as the current cutover holder
+// for anything else watching the lock key.
+type ConsulCutoverCoordinator struct {
+	Client  *api.Client
+	LockKey string
+	Config  *CutoverCoordinatorConfig
+
+	sessionID string
+	lock      *api.Lock
+}
+
+func NewConsulCutoverCoordinator(client *api.Client, lockKey string, config *CutoverCoordinatorConfig) *ConsulCutoverCoordinator {
+	return &ConsulCutoverCoordinator{Client: client, LockKey: lockKey, Config: config.withDefaults()}
+}
+
+func (c *ConsulCutoverCoordinator) Lock(ctx context.Context, meta CutoverCoordinatorMeta) (LeaseHandle, error) {
+	sessionID, _, err := c.Client.Session().Create(&api.SessionEntry{
+		TTL:      c.Config.LeaseTTL.String(),
+		Behavior: api.SessionBehaviorRelease,
+	}, nil)
+	if err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to create consul session: %v", err)
+	}
+
+	lock, err := c.Client.LockOpts(&api.LockOptions{
+		Key:     c.LockKey,
+		Session: sessionID,
+	})
+	if err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to build consul lock %s: %v", c.LockKey, err)
+	}
+
+	if _, err := lock.Lock(ctx.Done()); err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to acquire consul lock %s: %v", c.LockKey, err)
+	}
+
+	c.sessionID = sessionID
+	c.lock = lock
+
+	// The key's LockIndex goes up by one every time any session acquires the
+	// lock, so it serves as this acquisition's fencing token.
+	pair, _, err := c.Client.KV().Get(c.LockKey, nil)
+	if err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to read consul lock %s: %v", c.LockKey, err)
+	}
+	if pair == nil {
+		return LeaseHandle{}, fmt.Errorf("consul lock %s has no key after acquisition", c.LockKey)
+	}
+
+	return LeaseHandle{ID: sessionID, Token: pair.LockIndex}, nil
+}
+
+func (c *ConsulCutoverCoordinator) Renew(ctx context.Context, lease LeaseHandle) (LeaseHandle, error) {
+	entry, _, err := c.Client.Session().Renew(lease.ID, nil)
+	if err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to renew consul session %s: %v", lease.ID, err)
+	}
+	if entry == nil {
+		return LeaseHandle{}, fmt.Errorf("consul session %s no longer exists", lease.ID)
+	}
+
+	return LeaseHandle{ID: entry.ID, Token: lease.Token}, nil
+}
+
+func (c *ConsulCutoverCoordinator) Unlock(ctx context.Context, lease LeaseHandle) error {
+	if c.lock == nil {
+		return fmt.Errorf("no active consul lock for lease %s", lease.ID)
+	}
+
+	if err := c.lock.Unlock(); err != nil {
+		return fmt.Errorf("failed to release consul lock %s: %v", c.LockKey, err)
+	}
+
+	_, err := c.Client.Session().Destroy(c.sessionID, nil)
+	return err
+}
+
+// compareAndExpireScript atomically renews the lock's TTL only if it is
+// still held by this coordinator's token, so a lease that has already been
+// reclaimed by a new holder (or expired and been picked up by one) is never
+// extended out from under them.
+const compareAndExpireScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+else
+	return 0
+end
+`
+
+// compareAndDeleteScript atomically deletes the lock only if it is still
+// held by this coordinator's token, closing the classic GET-then-DEL race
+// where another holder acquires the key in between. It returns -1 if the
+// key is already gone (unlock is then a no-op, not an error), 0 if the key
+// is held by a different token, or the result of DEL otherwise.
+const compareAndDeleteScript = `
+local current = redis.call("GET", KEYS[1])
+if current == false then
+	return -1
+elseif current == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+else
+	return 0
+end
+`
+
+// RedisCutoverCoordinator takes a fenced lock in Redis using SET NX PX plus
+// a per-lock token counter (INCR), giving the fencing guarantee without
+// needing Redis's own session concept. Renew and Unlock both act on the
+// lock key via a Lua script so the compare-then-act is atomic against
+// Redis, not just against this process. The value stored at LockKey is a
+// random nonce minted fresh by every Lock call, not anything derived from
+// the run (e.g. its RunID): two processes racing to lock the same run would
+// otherwise compute the identical value, and the compare-and-swap the Lua
+// scripts perform would no longer distinguish one holder from the other.
+type RedisCutoverCoordinator struct {
+	Client  *redis.Client
+	LockKey string
+	Config  *CutoverCoordinatorConfig
+
+	token string
+}
+
+func NewRedisCutoverCoordinator(client *redis.Client, lockKey string, config *CutoverCoordinatorConfig) *RedisCutoverCoordinator {
+	return &RedisCutoverCoordinator{Client: client, LockKey: lockKey, Config: config.withDefaults()}
+}
+
+// randomToken mints a value unique enough to serve as this lock
+// acquisition's identity in Redis, so compareAndExpireScript/
+// compareAndDeleteScript can tell this holder apart from any other process
+// that might race to lock the same key.
+func randomToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (c *RedisCutoverCoordinator) Lock(ctx context.Context, meta CutoverCoordinatorMeta) (LeaseHandle, error) {
+	token, err := randomToken()
+	if err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to generate lock token for %s: %v", c.LockKey, err)
+	}
+
+	ok, err := c.Client.SetNX(ctx, c.LockKey, token, c.Config.LeaseTTL).Result()
+	if err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to acquire redis lock %s: %v", c.LockKey, err)
+	}
+	if !ok {
+		return LeaseHandle{}, fmt.Errorf("redis lock %s is already held", c.LockKey)
+	}
+
+	fencingToken, err := c.Client.Incr(ctx, c.LockKey+":fence").Result()
+	if err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to mint fencing token for %s: %v", c.LockKey, err)
+	}
+
+	c.token = token
+
+	return LeaseHandle{ID: meta.RunID, Token: uint64(fencingToken)}, nil
+}
+
+func (c *RedisCutoverCoordinator) Renew(ctx context.Context, lease LeaseHandle) (LeaseHandle, error) {
+	renewed, err := c.Client.Eval(ctx, compareAndExpireScript, []string{c.LockKey}, c.token, c.Config.LeaseTTL.Milliseconds()).Result()
+	if err != nil {
+		return LeaseHandle{}, fmt.Errorf("failed to renew redis lock %s: %v", c.LockKey, err)
+	}
+	if renewed == int64(0) {
+		return LeaseHandle{}, fmt.Errorf("redis lock %s is no longer held by this lease's token", c.LockKey)
+	}
+
+	return lease, nil
+}
+
+func (c *RedisCutoverCoordinator) Unlock(ctx context.Context, lease LeaseHandle) error {
+	result, err := c.Client.Eval(ctx, compareAndDeleteScript, []string{c.LockKey}, c.token).Result()
+	if err != nil {
+		return fmt.Errorf("failed to unlock redis lock %s: %v", c.LockKey, err)
+	}
+	if result == int64(0) {
+		return fmt.Errorf("redis lock %s is held by a different token, refusing to unlock", c.LockKey)
+	}
+
+	return nil
+}
@@ -0,0 +1,492 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Shopify/ghostferry"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/sirupsen/logrus"
+)
+
+// ShardingValueProvider supplies the set of tenants a MultiTenantShardingFerry
+// should migrate. It is queried once, at construction, rather than being a
+// static slice on Config, so the tenant list can be produced dynamically
+// (e.g. from a database query) without the caller resolving it up front.
+type ShardingValueProvider interface {
+	ShardingValues() ([]interface{}, error)
+}
+
+// tenant tracks the per-ShardingValue state that the single-tenant
+// ShardingFerry keeps directly on itself. Splitting it out is what lets N
+// tenants share one Ferry and one BinlogStreamer instead of each paying for
+// its own.
+type tenant struct {
+	value       interface{}
+	copyFilter  *ShardedCopyFilter
+	tableFilter *ShardedTableFilter
+	verifier    *ghostferry.IterativeVerifier
+}
+
+// MultiTenantShardingFerry drives a single Ferry and BinlogStreamer through
+// the sharding pipeline on behalf of many tenants at once. Every tenant
+// shares the lock, and the joined-table delta copy and primary-key-table
+// copy run once for all tenants, but verification and unlock during cutover
+// proceed per-tenant, so a slow tenant cannot hold up the others.
+type MultiTenantShardingFerry struct {
+	Ferry *ghostferry.Ferry
+
+	config  *Config
+	logger  *logrus.Entry
+	tenants []*tenant
+
+	coordinator CutoverCoordinator
+	renewer     *leaseRenewer
+	lease       LeaseHandle
+}
+
+// NewMultiTenantFerry builds a MultiTenantShardingFerry for every sharding
+// value produced by provider. Unlike NewFerry, config.ShardingValue is
+// ignored; the tenant list comes exclusively from provider.
+func NewMultiTenantFerry(config *Config, provider ShardingValueProvider) (*MultiTenantShardingFerry, error) {
+	values, err := provider.ShardingValues()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve sharding values: %v", err)
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("sharding value provider returned no tenants")
+	}
+
+	config.DatabaseRewrites = map[string]string{config.SourceDB: config.TargetDB}
+
+	ignored, err := compileRegexps(config.IgnoredTables)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile ignored tables: %v", err)
+	}
+
+	tenants := make([]*tenant, len(values))
+	for i, value := range values {
+		tenants[i] = &tenant{
+			value: value,
+			copyFilter: &ShardedCopyFilter{
+				ShardingKey:   config.ShardingKey,
+				ShardingValue: value,
+				JoinedTables:  config.JoinedTables,
+			},
+			tableFilter: &ShardedTableFilter{
+				ShardingKey:   config.ShardingKey,
+				SourceShard:   config.SourceDB,
+				JoinedTables:  config.JoinedTables,
+				IgnoredTables: ignored,
+			},
+		}
+	}
+
+	// The shared Ferry still needs a single CopyFilter/TableFilter pair to
+	// build its table schema cache and drive the one binlog stream. Every
+	// tenant shares the same tables and sharding key, so any one tenant's
+	// TableFilter works for that. CopyFilter is also what the shared Ferry's
+	// own row-copy pass uses, so it starts out pointed at tenants[0]; Run
+	// copies tenants[0] via that shared pass and then, since CopyFilter is
+	// what bounds which rows that pass sees, runs every other tenant through
+	// its own RunStandaloneDataCopy pass on a private Ferry/Config pair (see
+	// tenantCopyFerry) so their rows are not silently skipped.
+	config.CopyFilter = tenants[0].copyFilter
+	config.TableFilter = tenants[0].tableFilter
+
+	if err := config.ValidateConfig(); err != nil {
+		return nil, fmt.Errorf("failed to validate config: %v", err)
+	}
+
+	var throttler ghostferry.Throttler
+	if config.Throttle != nil {
+		throttler, err = ghostferry.NewLagThrottler(config.Throttle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create throttler: %v", err)
+		}
+	}
+
+	ferry := &ghostferry.Ferry{
+		Config:    config.Config,
+		Throttler: throttler,
+	}
+
+	logger := logrus.WithField("tag", "sharding")
+
+	ferry.ErrorHandler = &ShardingErrorHandler{
+		ErrorHandler: &ghostferry.PanicErrorHandler{
+			Ferry: ferry,
+		},
+		ErrorCallback: config.ErrorCallback,
+		Logger:        logger,
+	}
+
+	coordinator := config.CutoverCoordinator
+	if coordinator == nil {
+		coordinator = &HTTPCutoverCoordinator{Lock_: config.CutoverLock, Unlock_: config.CutoverUnlock}
+	}
+
+	return &MultiTenantShardingFerry{
+		Ferry:       ferry,
+		config:      config,
+		logger:      logger,
+		tenants:     tenants,
+		coordinator: coordinator,
+	}, nil
+}
+
+func (m *MultiTenantShardingFerry) Initialize() error {
+	return m.Ferry.Initialize()
+}
+
+func (m *MultiTenantShardingFerry) Start() error {
+	if err := m.Ferry.Start(); err != nil {
+		return err
+	}
+
+	verifierConcurrency := m.config.VerifierIterationConcurrency
+	if verifierConcurrency == 0 {
+		verifierConcurrency = m.config.DataIterationConcurrency
+	}
+
+	for _, t := range m.tenants {
+		t.verifier = &ghostferry.IterativeVerifier{
+			CursorConfig: &ghostferry.CursorConfig{
+				DB:          m.Ferry.SourceDB,
+				BatchSize:   m.config.DataIterationBatchSize,
+				ReadRetries: m.config.DBReadRetries,
+				BuildSelect: t.copyFilter.BuildSelect,
+			},
+
+			BinlogStreamer: m.Ferry.BinlogStreamer,
+
+			TableSchemaCache: m.Ferry.Tables,
+			Tables:           m.Ferry.Tables.AsSlice(),
+
+			SourceDB: m.Ferry.SourceDB,
+			TargetDB: m.Ferry.TargetDB,
+
+			DatabaseRewrites: m.config.DatabaseRewrites,
+			TableRewrites:    m.config.TableRewrites,
+
+			IgnoredTables: m.config.IgnoredVerificationTables,
+			Concurrency:   verifierConcurrency,
+		}
+
+		if err := t.verifier.Initialize(); err != nil {
+			return fmt.Errorf("failed to initialize verifier for tenant %v: %v", t.value, err)
+		}
+	}
+
+	return nil
+}
+
+// Run copies all tenants' rows under the one shared BinlogStreamer, takes a
+// single cutover lease (via the same CutoverCoordinator machinery
+// ShardingFerry uses) naming every tenant, delta-copies the joined tables and
+// copies the primary-key tables once, then verifies and unlocks each tenant
+// independently so that one slow tenant does not delay
+// the others' unlock. The lease is auto-renewed for as long as the cutover
+// window is open and is only released once every tenant has cut over.
+func (m *MultiTenantShardingFerry) Run() {
+	copyWG := &sync.WaitGroup{}
+	copyWG.Add(1)
+	go func() {
+		defer copyWG.Done()
+		m.Ferry.Run()
+	}()
+
+	m.Ferry.WaitUntilRowCopyIsComplete()
+
+	// The shared Ferry's own row-copy pass only ever sees tenants[0], since
+	// CopyFilter is a single field on the Ferry and that is what it started
+	// out pointed at. Every other tenant needs its own pass before row copy
+	// can be considered complete for the whole run.
+	m.forEachTenantIn(m.tenants[1:], func(t *tenant) error {
+		return m.copyTenantRows(t)
+	}, "row copy failed for tenant")
+
+	m.forEachTenant(func(t *tenant) error {
+		var err error
+		tags := tenantTags(t)
+		metrics.Measure("VerifyBeforeCutover", tags, 1.0, func() {
+			err = t.verifier.VerifyBeforeCutover()
+		})
+		return err
+	}, "pre-cutover verification encountered an error, aborting run")
+
+	ghostferry.WaitForThrottle(m.Ferry.Throttler)
+	m.Ferry.WaitUntilBinlogStreamerCatchesUp()
+
+	client := &http.Client{}
+	values := m.shardingValues()
+
+	// The lock is taken once, against a single lease, naming every tenant:
+	// it guards this process's right to perform the shared delta-copy/PK-copy
+	// writes below, the same way ShardingFerry's single-tenant lease does.
+	var err error
+	metrics.Measure("CutoverLock", nil, 1.0, func() {
+		m.lease, err = m.coordinator.Lock(context.Background(), CutoverCoordinatorMeta{RunID: m.runID(), Tenants: values})
+	})
+	if err != nil {
+		m.logger.WithField("error", err).Errorf("locking failed, aborting run")
+		m.Ferry.ErrorHandler.Fatal("sharding", err)
+		return
+	}
+
+	if err := ensureFenceTable(context.Background(), m.Ferry.TargetDB); err != nil {
+		m.logger.WithField("error", err).Errorf("failed to create cutover fencing table")
+		m.Ferry.ErrorHandler.Fatal("sharding", err)
+		return
+	}
+
+	m.renewer = newLeaseRenewer(m.coordinator, m.config.CutoverCoordinatorConfig, func(err error) {
+		m.logger.WithField("error", err).Errorf("cutover lease renewal failed, aborting run")
+		m.Ferry.ErrorHandler.Fatal("sharding", err)
+	})
+	stopRenewing := m.renewer.start(m.lease)
+	defer stopRenewing()
+
+	m.Ferry.Throttler.SetDisabled(true)
+	m.Ferry.FlushBinlogAndStopStreaming()
+	copyWG.Wait()
+
+	if err := m.assertLeaseHeld(); err != nil {
+		m.Ferry.ErrorHandler.Fatal("sharding", err)
+		return
+	}
+
+	// Joined tables are unsharded and so are copied once, in full, rather
+	// than per tenant.
+	metrics.Measure("deltaCopyJoinedTables", nil, 1.0, func() {
+		err = m.Ferry.RunStandaloneDataCopy(joinedTables(m.Ferry.Tables, m.config.JoinedTables))
+	})
+	if err != nil {
+		m.logger.WithField("error", err).Errorf("failed to delta-copy joined tables after locking")
+		m.Ferry.ErrorHandler.Fatal("sharding", err)
+		return
+	}
+
+	if err := m.assertLeaseHeld(); err != nil {
+		m.Ferry.ErrorHandler.Fatal("sharding", err)
+		return
+	}
+
+	if err := m.copyPrimaryKeyTables(); err != nil {
+		m.logger.WithField("error", err).Errorf("copying primary key tables failed")
+		m.Ferry.ErrorHandler.Fatal("sharding", err)
+		return
+	}
+
+	m.forEachTenant(func(t *tenant) error {
+		return m.cutoverTenant(t, client)
+	}, "cutover failed for tenant")
+
+	if err := m.assertLeaseHeld(); err != nil {
+		m.Ferry.ErrorHandler.Fatal("sharding", err)
+		return
+	}
+
+	stopRenewing()
+	metrics.Measure("CutoverUnlock", nil, 1.0, func() {
+		err = m.coordinator.Unlock(context.Background(), m.renewer.currentLease())
+	})
+	if err != nil {
+		m.logger.WithField("error", err).Errorf("unlocking failed, aborting run")
+		m.Ferry.ErrorHandler.Fatal("sharding", err)
+		return
+	}
+
+	m.Ferry.Throttler.SetDisabled(false)
+}
+
+// assertLeaseHeld mirrors ShardingFerry.assertLeaseHeld: it refuses to let
+// the run proceed once the background renewal goroutine has stopped
+// believing it holds the cutover lease, and then claims the lease's fencing
+// token against the target so a stale multi-tenant ferry's writes are
+// rejected by the target itself, not just by its own (possibly stale)
+// in-memory belief that it still holds the lease.
+func (m *MultiTenantShardingFerry) assertLeaseHeld() error {
+	if m.renewer == nil {
+		return nil
+	}
+	if m.renewer.isLost() {
+		return fmt.Errorf("cutover lease for run %s was lost, refusing to write", m.runID())
+	}
+
+	return claimFence(context.Background(), m.Ferry.TargetDB, m.runID(), m.renewer.currentLease().Token)
+}
+
+func (m *MultiTenantShardingFerry) cutoverTenant(t *tenant, client *http.Client) error {
+	tags := tenantTags(t)
+	cutoverStart := time.Now()
+
+	var verificationResult ghostferry.VerificationResult
+	var err error
+	metrics.Measure("VerifyCutover", tags, 1.0, func() {
+		verificationResult, err = t.verifier.VerifyDuringCutover()
+	})
+	if err != nil {
+		return fmt.Errorf("verification: %v", err)
+	} else if !verificationResult.DataCorrect {
+		return fmt.Errorf("verifier detected data discrepancy: %s", verificationResult.Message)
+	}
+
+	unlockRetry := defaultUnlockRetryConfig()
+	attempts := 0
+	metrics.Measure("CutoverUnlock", tags, 1.0, func() {
+		err = retryCutoverCallback(client, m.config.CutoverUnlock, m.runID(), fmt.Sprintf("unlock-%v", t.value), []interface{}{t.value}, unlockRetry, func(attempt int) {
+			attempts = attempt
+			metrics.Count("CutoverUnlockRetries", 1, tags, 1.0)
+		})
+	})
+	if err != nil {
+		if unlockRetry.withDefaults().IsRetryable(err) {
+			return &CutoverUnlockAbandoned{
+				IdempotencyKey: fmt.Sprintf("%s-unlock-%v-%d", m.runID(), t.value, attempts+1),
+				LastErr:        err,
+			}
+		}
+		return fmt.Errorf("unlocking: %v", err)
+	}
+
+	metrics.Timer("CutoverTime", time.Since(cutoverStart), tags, 1.0)
+	return nil
+}
+
+// copyPrimaryKeyTables copies the tables configured as PrimaryKeyTables,
+// which (like joined tables) are not sharded and so are copied once rather
+// than per tenant.
+func (m *MultiTenantShardingFerry) copyPrimaryKeyTables() error {
+	pkTables := map[string]struct{}{}
+	for _, name := range m.config.PrimaryKeyTables {
+		pkTables[name] = struct{}{}
+	}
+
+	representative := m.tenants[0]
+	representative.tableFilter.PrimaryKeyTables = pkTables
+	representative.copyFilter.PrimaryKeyTables = pkTables
+
+	sourceDbTables, err := ghostferry.LoadTables(m.Ferry.SourceDB, representative.tableFilter)
+	if err != nil {
+		return err
+	}
+
+	tables := []*schema.Table{}
+	for _, table := range sourceDbTables.AsSlice() {
+		if _, exists := pkTables[table.Name]; exists {
+			if len(table.PKColumns) != 1 {
+				return fmt.Errorf("multiple PK columns are not supported with the PrimaryKeyTables tables option")
+			}
+			tables = append(tables, table)
+		}
+	}
+
+	if len(tables) == 0 {
+		m.logger.Warn("found no primary key tables to copy")
+	}
+
+	return m.Ferry.RunStandaloneDataCopy(tables)
+}
+
+// copyTenantRows runs a standalone row-copy pass for a single tenant's
+// sharded tables. Rather than swapping the shared Ferry.Config.CopyFilter
+// field (which would force every concurrent tenant copy to serialize around
+// the swap), it builds a private Ferry/Config pair that shares everything
+// else with m.Ferry but points CopyFilter at this tenant alone, so
+// forEachTenant's tenants can genuinely copy in parallel, bounded only by
+// DataIterationConcurrency.
+func (m *MultiTenantShardingFerry) copyTenantRows(t *tenant) error {
+	return m.tenantCopyFerry(t).RunStandaloneDataCopy(m.shardedTables())
+}
+
+// tenantCopyFerry returns a *ghostferry.Ferry for t's standalone row-copy
+// pass. It is a shallow copy of m.Ferry, so it shares the same connections,
+// schema cache and binlog streamer, but carries its own *ghostferry.Config
+// with CopyFilter pointed at t's ShardedCopyFilter instead of the one the
+// shared Ferry was constructed with.
+func (m *MultiTenantShardingFerry) tenantCopyFerry(t *tenant) *ghostferry.Ferry {
+	config := *m.Ferry.Config
+	config.CopyFilter = t.copyFilter
+
+	ferry := *m.Ferry
+	ferry.Config = &config
+	return &ferry
+}
+
+// shardedTables returns the tables that are sharded by ShardingKey, i.e.
+// every table except those configured as JoinedTables or PrimaryKeyTables,
+// which are unsharded and copied once rather than per tenant.
+func (m *MultiTenantShardingFerry) shardedTables() []*schema.Table {
+	pkTables := map[string]bool{}
+	for _, name := range m.config.PrimaryKeyTables {
+		pkTables[name] = true
+	}
+
+	tables := []*schema.Table{}
+	for _, table := range m.Ferry.Tables.AsSlice() {
+		if m.config.JoinedTables[table.Name] || pkTables[table.Name] {
+			continue
+		}
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// forEachTenant runs fn across all tenants concurrently, bounded by
+// DataIterationConcurrency, and fatals the run with the first error
+// encountered.
+func (m *MultiTenantShardingFerry) forEachTenant(fn func(*tenant) error, fatalMessage string) {
+	m.forEachTenantIn(m.tenants, fn, fatalMessage)
+}
+
+// forEachTenantIn is forEachTenant restricted to a subset of tenants, so
+// callers that have already handled one tenant specially (e.g. the one the
+// shared Ferry copies directly) can run the rest through the same
+// bounded-pool/fatal-on-error machinery.
+func (m *MultiTenantShardingFerry) forEachTenantIn(tenants []*tenant, fn func(*tenant) error, fatalMessage string) {
+	concurrency := m.config.DataIterationConcurrency
+	if concurrency == 0 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+
+	for _, t := range tenants {
+		t := t
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := fn(t); err != nil {
+				m.logger.WithField("error", err).WithField("sharding_value", t.value).Errorf(fatalMessage)
+				m.Ferry.ErrorHandler.Fatal("sharding", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *MultiTenantShardingFerry) shardingValues() []interface{} {
+	values := make([]interface{}, len(m.tenants))
+	for i, t := range m.tenants {
+		values[i] = t.value
+	}
+	return values
+}
+
+// runID identifies this multi-tenant run to the cutover callbacks, mirroring
+// ShardingFerry.runID.
+func (m *MultiTenantShardingFerry) runID() string {
+	return fmt.Sprintf("%s->%s", m.config.SourceDB, m.config.TargetDB)
+}
+
+func tenantTags(t *tenant) map[string]string {
+	return map[string]string{"sharding_value": fmt.Sprintf("%v", t.value)}
+}
@@ -0,0 +1,187 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// CutoverCallback is what HTTPCutoverCoordinator calls to reach the app's
+// lock/unlock endpoint. Its Post is expected to set the given key as an
+// Idempotency-Key header (or equivalent) so a retried POST can be safely
+// deduped by the app.
+type CutoverCallback interface {
+	Post(client *http.Client, idempotencyKey string, tenants ...interface{}) error
+}
+
+// HTTPCallback is the default CutoverCallback: it POSTs to URL with the
+// idempotency key set as the Idempotency-Key header and the tenant values
+// JSON-encoded as the body, so the app on the other end can dedupe retried
+// calls and see which tenants a lock/unlock call covers.
+type HTTPCallback struct {
+	URL string
+}
+
+func (h *HTTPCallback) Post(client *http.Client, idempotencyKey string, tenants ...interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"tenants": tenants})
+	if err != nil {
+		return fmt.Errorf("failed to encode cutover callback body: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build cutover callback request: %v", err)
+	}
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// StatusError is returned by a CutoverCallback implementation to report a
+// non-2xx HTTP response, so IsRetryable can distinguish a transient 5xx from
+// a terminal 4xx without parsing error strings.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("cutover callback returned HTTP %d", e.StatusCode)
+}
+
+// IsRetryable classifies an error from a cutover callback as transient
+// (network blips, request timeouts, 5xx) or terminal (4xx, config errors).
+// Callers can override this via RetryConfig.IsRetryable for app-specific
+// error shapes.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if statusErr, ok := err.(*StatusError); ok {
+		return statusErr.StatusCode >= 500
+	}
+
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+
+	if err == context.DeadlineExceeded {
+		return true
+	}
+
+	return false
+}
+
+// RetryConfig controls the backoff schedule used when retrying a single
+// cutover callback.
+type RetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	IsRetryable    func(error) bool
+}
+
+func (c *RetryConfig) withDefaults() *RetryConfig {
+	var cfg RetryConfig
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.InitialBackoff == 0 {
+		cfg.InitialBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.IsRetryable == nil {
+		cfg.IsRetryable = IsRetryable
+	}
+	return &cfg
+}
+
+// defaultUnlockRetryConfig retries considerably harder than the lock-side
+// default: leaving the app locked after a dropped cutover is worse than a
+// slow lock acquisition, so unlock is worth chasing further.
+func defaultUnlockRetryConfig() *RetryConfig {
+	return &RetryConfig{
+		MaxAttempts:    15,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     time.Minute,
+	}
+}
+
+// CutoverUnlockAbandoned is returned when the unlock callback exhausts all
+// retries. It carries the idempotency key of the final attempt so operators
+// can correlate it with the app's logs and manually clear the lock.
+type CutoverUnlockAbandoned struct {
+	IdempotencyKey string
+	LastErr        error
+}
+
+func (e *CutoverUnlockAbandoned) Error() string {
+	return fmt.Sprintf("cutover unlock abandoned after retries (idempotency key %s): %v", e.IdempotencyKey, e.LastErr)
+}
+
+func (e *CutoverUnlockAbandoned) Unwrap() error {
+	return e.LastErr
+}
+
+// retryCutoverCallback calls callback.Post, identified by runID/stage, up to
+// config.MaxAttempts times, backing off exponentially with jitter between
+// retryable failures. A terminal error (per config.IsRetryable) is returned
+// immediately without further attempts.
+func retryCutoverCallback(client *http.Client, callback CutoverCallback, runID, stage string, tenants []interface{}, config *RetryConfig, onRetry func(attempt int)) error {
+	config = config.withDefaults()
+
+	var lastErr error
+	backoff := config.InitialBackoff
+
+	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
+		idempotencyKey := fmt.Sprintf("%s-%s-%d", runID, stage, attempt)
+
+		lastErr = callback.Post(client, idempotencyKey, tenants...)
+		if lastErr == nil {
+			return nil
+		}
+
+		if !config.IsRetryable(lastErr) {
+			return lastErr
+		}
+
+		if attempt == config.MaxAttempts {
+			break
+		}
+
+		if onRetry != nil {
+			onRetry(attempt)
+		}
+
+		jitter := time.Duration(rand.Int63n(int64(backoff) / 2))
+		time.Sleep(backoff/2 + jitter)
+
+		backoff *= 2
+		if backoff > config.MaxBackoff {
+			backoff = config.MaxBackoff
+		}
+	}
+
+	return lastErr
+}
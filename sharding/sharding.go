@@ -1,8 +1,8 @@
 package sharding
 
 import (
+	"context"
 	"fmt"
-	"net/http"
 	"regexp"
 	"sync"
 	"time"
@@ -17,9 +17,32 @@ type ShardingFerry struct {
 	verifier *ghostferry.IterativeVerifier
 	config   *Config
 	logger   *logrus.Entry
+
+	checkpointStore CheckpointStore
+	resumeFrom      *Checkpoint
+
+	stageMu sync.Mutex
+	stage   Stage
+
+	coordinator CutoverCoordinator
+	renewer     *leaseRenewer
+	lease       LeaseHandle
+}
+
+// FerryOption customizes a ShardingFerry at construction time, beyond what
+// Config alone expresses.
+type FerryOption func(*ShardingFerry)
+
+// WithCheckpointStore attaches a CheckpointStore so the resulting
+// ShardingFerry periodically snapshots its progress and can later be
+// resumed with Resume().
+func WithCheckpointStore(store CheckpointStore) FerryOption {
+	return func(r *ShardingFerry) {
+		r.checkpointStore = store
+	}
 }
 
-func NewFerry(config *Config) (*ShardingFerry, error) {
+func NewFerry(config *Config, opts ...FerryOption) (*ShardingFerry, error) {
 	var err error
 
 	config.DatabaseRewrites = map[string]string{config.SourceDB: config.TargetDB}
@@ -70,11 +93,23 @@ func NewFerry(config *Config) (*ShardingFerry, error) {
 		Logger:        logger,
 	}
 
-	return &ShardingFerry{
-		Ferry:  ferry,
-		config: config,
-		logger: logger,
-	}, nil
+	coordinator := config.CutoverCoordinator
+	if coordinator == nil {
+		coordinator = &HTTPCutoverCoordinator{Lock_: config.CutoverLock, Unlock_: config.CutoverUnlock}
+	}
+
+	shardingFerry := &ShardingFerry{
+		Ferry:       ferry,
+		config:      config,
+		logger:      logger,
+		coordinator: coordinator,
+	}
+
+	for _, opt := range opts {
+		opt(shardingFerry)
+	}
+
+	return shardingFerry, nil
 }
 
 func (r *ShardingFerry) Initialize() error {
@@ -115,10 +150,27 @@ func (r *ShardingFerry) Start() error {
 		Concurrency:   verifierConcurrency,
 	}
 
-	return r.verifier.Initialize()
+	if err := r.verifier.Initialize(); err != nil {
+		return err
+	}
+
+	if r.resumeFrom != nil {
+		entries := make([]ghostferry.ReverifyEntry, 0, len(r.resumeFrom.ReverifyQueue))
+		for _, entry := range r.resumeFrom.ReverifyQueue {
+			entries = append(entries, ghostferry.ReverifyEntry{Table: entry.TableName, PK: entry.PK})
+		}
+		r.verifier.QueueReverify(entries)
+	}
+
+	return nil
 }
 
 func (r *ShardingFerry) Run() {
+	stopCheckpointing := r.startCheckpointing()
+	defer stopCheckpointing()
+
+	r.setStage(StageRowCopy)
+
 	copyWG := &sync.WaitGroup{}
 	copyWG.Add(1)
 	go func() {
@@ -128,68 +180,102 @@ func (r *ShardingFerry) Run() {
 
 	r.Ferry.WaitUntilRowCopyIsComplete()
 
-	metrics.Measure("VerifyBeforeCutover", nil, 1.0, func() {
-		err := r.verifier.VerifyBeforeCutover()
-		if err != nil {
-			r.logger.WithField("error", err).Errorf("pre-cutover verification encountered an error, aborting run")
-			r.Ferry.ErrorHandler.Fatal("sharding", err)
-		}
-	})
+	r.setStage(StagePreVerify)
+	if r.pastStage(StagePreVerify) {
+		r.logger.Info("resuming from a checkpoint that already completed pre-cutover verification, skipping it")
+	} else {
+		metrics.Measure("VerifyBeforeCutover", nil, 1.0, func() {
+			err := r.verifier.VerifyBeforeCutover()
+			if err != nil {
+				r.logger.WithField("error", err).Errorf("pre-cutover verification encountered an error, aborting run")
+				r.Ferry.ErrorHandler.Fatal("sharding", err)
+			}
+		})
+	}
 
 	ghostferry.WaitForThrottle(r.Ferry.Throttler)
 
 	r.Ferry.WaitUntilBinlogStreamerCatchesUp()
 
 	var err error
-	client := &http.Client{}
 
+	r.setStage(StageCutover)
 	cutoverStart := time.Now()
 	// The callback must ensure that all in-flight transactions are complete and
 	// there will be no more writes to the database after it returns.
 	metrics.Measure("CutoverLock", nil, 1.0, func() {
-		err = r.config.CutoverLock.Post(client)
+		r.lease, err = r.coordinator.Lock(context.Background(), CutoverCoordinatorMeta{RunID: r.runID()})
 	})
 	if err != nil {
 		r.logger.WithField("error", err).Errorf("locking failed, aborting run")
 		r.Ferry.ErrorHandler.Fatal("sharding", err)
 	}
 
+	if err := ensureFenceTable(context.Background(), r.Ferry.TargetDB); err != nil {
+		r.logger.WithField("error", err).Errorf("failed to create cutover fencing table")
+		r.Ferry.ErrorHandler.Fatal("sharding", err)
+	}
+
+	r.renewer = newLeaseRenewer(r.coordinator, r.config.CutoverCoordinatorConfig, func(err error) {
+		r.logger.WithField("error", err).Errorf("cutover lease renewal failed, aborting run")
+		r.Ferry.ErrorHandler.Fatal("sharding", err)
+	})
+	stopRenewing := r.renewer.start(r.lease)
+	defer stopRenewing()
+
 	r.Ferry.Throttler.SetDisabled(true)
 
 	r.Ferry.FlushBinlogAndStopStreaming()
 	copyWG.Wait()
 
-	metrics.Measure("deltaCopyJoinedTables", nil, 1.0, func() {
-		err = r.deltaCopyJoinedTables()
-	})
-	if err != nil {
-		r.logger.WithField("error", err).Errorf("failed to delta-copy joined tables after locking")
+	if err := r.assertLeaseHeld(); err != nil {
 		r.Ferry.ErrorHandler.Fatal("sharding", err)
 	}
 
-	var verificationResult ghostferry.VerificationResult
-	metrics.Measure("VerifyCutover", nil, 1.0, func() {
-		verificationResult, err = r.verifier.VerifyDuringCutover()
-	})
-	if err != nil {
-		r.logger.WithField("error", err).Errorf("verification encountered an error, aborting run")
-		r.Ferry.ErrorHandler.Fatal("iterative_verifier", err)
-	} else if !verificationResult.DataCorrect {
-		err = fmt.Errorf("verifier detected data discrepancy: %s", verificationResult.Message)
-		r.logger.WithField("error", err).Errorf("verification failed, aborting run")
-		r.Ferry.ErrorHandler.Fatal("iterative_verifier", err)
+	if r.pastStage(StageCutover) {
+		r.logger.Info("resuming from a checkpoint that already completed the cutover stage, skipping delta copy and cutover verification")
+	} else {
+		metrics.Measure("deltaCopyJoinedTables", nil, 1.0, func() {
+			err = r.deltaCopyJoinedTables()
+		})
+		if err != nil {
+			r.logger.WithField("error", err).Errorf("failed to delta-copy joined tables after locking")
+			r.Ferry.ErrorHandler.Fatal("sharding", err)
+		}
+
+		var verificationResult ghostferry.VerificationResult
+		metrics.Measure("VerifyCutover", nil, 1.0, func() {
+			verificationResult, err = r.verifier.VerifyDuringCutover()
+		})
+		if err != nil {
+			r.logger.WithField("error", err).Errorf("verification encountered an error, aborting run")
+			r.Ferry.ErrorHandler.Fatal("iterative_verifier", err)
+		} else if !verificationResult.DataCorrect {
+			err = fmt.Errorf("verifier detected data discrepancy: %s", verificationResult.Message)
+			r.logger.WithField("error", err).Errorf("verification failed, aborting run")
+			r.Ferry.ErrorHandler.Fatal("iterative_verifier", err)
+		}
 	}
 
 	r.Ferry.Throttler.SetDisabled(false)
 
+	r.setStage(StagePKCopy)
+	if err := r.assertLeaseHeld(); err != nil {
+		r.Ferry.ErrorHandler.Fatal("sharding", err)
+	}
 	err = r.copyPrimaryKeyTables()
 	if err != nil {
 		r.logger.WithField("error", err).Errorf("copying primary key table failed")
 		r.Ferry.ErrorHandler.Fatal("sharding", err)
 	}
 
+	if err := r.assertLeaseHeld(); err != nil {
+		r.Ferry.ErrorHandler.Fatal("sharding", err)
+	}
+
+	stopRenewing()
 	metrics.Measure("CutoverUnlock", nil, 1.0, func() {
-		err = r.config.CutoverUnlock.Post(client)
+		err = r.coordinator.Unlock(context.Background(), r.renewer.currentLease())
 	})
 	if err != nil {
 		r.logger.WithField("error", err).Errorf("unlocking failed, aborting run")
@@ -200,15 +286,71 @@ func (r *ShardingFerry) Run() {
 }
 
 func (r *ShardingFerry) deltaCopyJoinedTables() error {
-	tables := []*schema.Table{}
+	tables := r.excludeCompletedTables(joinedTables(r.Ferry.Tables, r.config.JoinedTables))
+	r.config.CopyFilter.(*ShardedCopyFilter).MinPrimaryKeys = r.resumeCursors(tables)
+	return r.Ferry.RunStandaloneDataCopy(tables)
+}
 
-	for _, table := range r.Ferry.Tables {
-		if _, exists := r.config.JoinedTables[table.Name]; exists {
-			tables = append(tables, table)
+// pastStage reports whether the checkpoint this run resumed from had
+// already moved on from stage, so Run can skip redoing the work that stage
+// represents. It is always false on a fresh run, since resumeFrom is nil
+// until Resume has loaded a checkpoint.
+func (r *ShardingFerry) pastStage(stage Stage) bool {
+	return r.resumeFrom != nil && r.resumeFrom.Stage > stage
+}
+
+// excludeCompletedTables drops any table the checkpoint this run resumed
+// from had already marked Done, so a resumed RunStandaloneDataCopy does not
+// redo work the interrupted run already finished. It is a no-op on a fresh
+// run.
+func (r *ShardingFerry) excludeCompletedTables(tables []*schema.Table) []*schema.Table {
+	if r.resumeFrom == nil {
+		return tables
+	}
+
+	remaining := make([]*schema.Table, 0, len(tables))
+	for _, table := range tables {
+		if progress, ok := r.resumeFrom.TableProgress[table.Name]; ok && progress.Done {
+			continue
 		}
+		remaining = append(remaining, table)
 	}
+	return remaining
+}
 
-	return r.Ferry.RunStandaloneDataCopy(tables)
+// resumeCursors returns, for each of tables that the checkpoint this run
+// resumed from had recorded progress for but not yet marked Done, the last
+// primary key that checkpoint saw successfully copied. The copy filter uses
+// these as a lower bound so a resumed copy skips the row ranges the
+// interrupted run already finished instead of re-copying each table from
+// scratch. It is a no-op (nil) on a fresh run.
+func (r *ShardingFerry) resumeCursors(tables []*schema.Table) map[string]uint64 {
+	if r.resumeFrom == nil {
+		return nil
+	}
+
+	cursors := map[string]uint64{}
+	for _, table := range tables {
+		if progress, ok := r.resumeFrom.TableProgress[table.Name]; ok && !progress.Done && progress.LastPK > 0 {
+			cursors[table.Name] = progress.LastPK
+		}
+	}
+	return cursors
+}
+
+// joinedTables returns the subset of tables that are configured as joined
+// (i.e. not themselves sharded, and so copied in full rather than filtered
+// by sharding value).
+func joinedTables(tables ghostferry.TableSchemaCache, joined map[string]bool) []*schema.Table {
+	result := []*schema.Table{}
+
+	for _, table := range tables {
+		if _, exists := joined[table.Name]; exists {
+			result = append(result, table)
+		}
+	}
+
+	return result
 }
 
 func (r *ShardingFerry) copyPrimaryKeyTables() error {
@@ -239,9 +381,42 @@ func (r *ShardingFerry) copyPrimaryKeyTables() error {
 		r.logger.Warn("found no primary key tables to copy")
 	}
 
+	tables = r.excludeCompletedTables(tables)
+	r.config.CopyFilter.(*ShardedCopyFilter).MinPrimaryKeys = r.resumeCursors(tables)
 	return r.Ferry.RunStandaloneDataCopy(tables)
 }
 
+// runID identifies this ferry run to the CutoverCoordinator. It is derived
+// from the run's source/target pair rather than generated fresh, so that a
+// restarted process attempting to lock the same migration is recognizable
+// as the same run rather than a new competitor for the lease.
+func (r *ShardingFerry) runID() string {
+	return fmt.Sprintf("%s->%s", r.config.SourceDB, r.config.TargetDB)
+}
+
+// assertLeaseHeld refuses to let the run proceed once the background
+// renewal goroutine has stopped believing it holds the lease, and then
+// claims the lease's fencing token against the target via claimFence. The
+// in-memory isLost() check alone has a TOCTOU gap (the renewal goroutine
+// may not yet have noticed a lost lease), so call sites that are about to
+// perform a write during the cutover window rely on claimFence to have the
+// target itself reject a write from a ferry some other run's higher token
+// has since superseded, rather than trusting client-side state alone.
+func (r *ShardingFerry) assertLeaseHeld() error {
+	if r.renewer == nil {
+		return nil
+	}
+	if r.renewer.isLost() {
+		return fmt.Errorf("cutover lease for run %s was lost, refusing to write", r.runID())
+	}
+
+	if err := claimFence(context.Background(), r.Ferry.TargetDB, r.runID(), r.renewer.currentLease().Token); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func compileRegexps(exps []string) ([]*regexp.Regexp, error) {
 	var err error
 	res := make([]*regexp.Regexp, len(exps))
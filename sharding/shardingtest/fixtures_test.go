@@ -0,0 +1,167 @@
+package shardingtest_test
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/ghostferry"
+	"github.com/Shopify/ghostferry/sharding"
+	"github.com/Shopify/ghostferry/sharding/shardingtest"
+)
+
+const fixtureDDL = `
+CREATE TABLE IF NOT EXISTS %s (
+	id INT PRIMARY KEY AUTO_INCREMENT,
+	tenant_id INT NOT NULL,
+	value VARCHAR(255) NOT NULL
+)`
+
+// resetFixture drops and recreates the fixture tables on both source and
+// target, then seeds two tenants' worth of rows on the source so each
+// scenario starts from the same known state.
+func resetFixture(t *testing.T, h *shardingtest.Harness) {
+	for _, table := range []string{"gftest1", "gftest_joined"} {
+		for _, db := range []*sql.DB{h.SourceDB, h.TargetDB} {
+			if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table)); err != nil {
+				t.Fatalf("failed to drop %s: %v", table, err)
+			}
+			if _, err := db.Exec(fmt.Sprintf(fixtureDDL, table)); err != nil {
+				t.Fatalf("failed to create %s: %v", table, err)
+			}
+		}
+	}
+
+	for tenant := 1; tenant <= 2; tenant++ {
+		for i := 0; i < 5; i++ {
+			if _, err := h.SourceDB.Exec("INSERT INTO gftest1 (tenant_id, value) VALUES (?, ?)", tenant, fmt.Sprintf("row-%d-%d", tenant, i)); err != nil {
+				t.Fatalf("failed to seed gftest1: %v", err)
+			}
+		}
+	}
+}
+
+func baseConfig(h *shardingtest.Harness, server *shardingtest.CutoverServer) *sharding.Config {
+	return &sharding.Config{
+		SourceDB:      "gftest",
+		TargetDB:      "gftest",
+		ShardingKey:   "tenant_id",
+		ShardingValue: 1,
+		JoinedTables:  map[string]bool{"gftest_joined": true},
+		CutoverLock:   &sharding.HTTPCallback{URL: server.URL + "/lock"},
+		CutoverUnlock: &sharding.HTTPCallback{URL: server.URL + "/unlock"},
+	}
+}
+
+func runFerry(t *testing.T, h *shardingtest.Harness, server *shardingtest.CutoverServer, config *sharding.Config) {
+	ferry, err := h.NewFerry(config)
+	if err != nil {
+		t.Fatalf("failed to build ferry: %v", err)
+	}
+	runToCompletion(t, ferry)
+}
+
+func runToCompletion(t *testing.T, ferry *sharding.ShardingFerry) {
+	if err := ferry.Initialize(); err != nil {
+		t.Fatalf("failed to initialize ferry: %v", err)
+	}
+	if err := ferry.Start(); err != nil {
+		t.Fatalf("failed to start ferry: %v", err)
+	}
+	ferry.Run()
+}
+
+// interruptMidCopy starts the ferry, waits for it to have actually saved a
+// checkpoint, then kills and restarts the source container out from under
+// it so the run is abruptly cut off (rather than completing or exiting
+// cleanly), and waits for the run to actually stop before returning. This is
+// what the next step exercises Resume against: the checkpoint waited for
+// here.
+func interruptMidCopy(t *testing.T, h *shardingtest.Harness, ferry *sharding.ShardingFerry, store sharding.CheckpointStore) {
+	if err := ferry.Initialize(); err != nil {
+		t.Fatalf("failed to initialize ferry: %v", err)
+	}
+	if err := ferry.Start(); err != nil {
+		t.Fatalf("failed to start ferry: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Run's ErrorHandler is a PanicErrorHandler, so the interruption
+		// below makes it panic; that panic must not escape this goroutine
+		// and crash the whole test binary.
+		defer func() { _ = recover() }()
+		ferry.Run()
+	}()
+
+	waitForCheckpoint(t, store)
+	h.RestartSourceContainer(t)
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("interrupted ferry run did not stop after the source container was restarted")
+	}
+}
+
+// waitForCheckpoint polls store until it holds a checkpoint, rather than
+// sleeping a fixed duration: ShardingFerry.Run saves one immediately on
+// entering its first stage (see setStage), but that still races the kill
+// below against the goroutine Run() starts on, so interruptMidCopy must
+// confirm the checkpoint landed before restarting the source container out
+// from under it.
+func waitForCheckpoint(t *testing.T, store sharding.CheckpointStore) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		checkpoint, err := store.Load()
+		if err != nil {
+			t.Fatalf("failed to poll for checkpoint: %v", err)
+		}
+		if checkpoint != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no checkpoint was saved before timeout")
+}
+
+// assertRunFatals drives a ferry expected to call ErrorHandler.Fatal, and
+// fails the test unless the panic it raises mentions wantSubstring.
+func assertRunFatals(t *testing.T, h *shardingtest.Harness, server *shardingtest.CutoverServer, config *sharding.Config, wantSubstring string) {
+	ferry, err := h.NewFerry(config)
+	if err != nil {
+		t.Fatalf("failed to build ferry: %v", err)
+	}
+	ferry.Ferry.ErrorHandler = &ghostferry.PanicErrorHandler{Ferry: ferry.Ferry}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatalf("expected run to fatal with %q, but it completed", wantSubstring)
+		}
+
+		message := fmt.Sprintf("%v", r)
+		if !strings.Contains(message, wantSubstring) {
+			t.Fatalf("expected fatal error to contain %q, got %q", wantSubstring, message)
+		}
+	}()
+
+	runToCompletion(t, ferry)
+}
+
+func plantDelta(t *testing.T, h *shardingtest.Harness, table string, tenantID int) {
+	if _, err := h.TargetDB.Exec(fmt.Sprintf("INSERT INTO %s (tenant_id, value) VALUES (?, ?)", table), tenantID, "planted-delta"); err != nil {
+		t.Fatalf("failed to plant delta in %s: %v", table, err)
+	}
+}
+
+func seedJoinedTableRows(t *testing.T, h *shardingtest.Harness, table string, count int) {
+	for i := 0; i < count; i++ {
+		if _, err := h.SourceDB.Exec(fmt.Sprintf("INSERT INTO %s (tenant_id, value) VALUES (?, ?)", table), 1, fmt.Sprintf("joined-%d", i)); err != nil {
+			t.Fatalf("failed to seed %s: %v", table, err)
+		}
+	}
+}
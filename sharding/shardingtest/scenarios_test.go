@@ -0,0 +1,105 @@
+package shardingtest_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Shopify/ghostferry/sharding"
+	"github.com/Shopify/ghostferry/sharding/shardingtest"
+)
+
+// scenario is one row of the table-driven cutover suite below. Each
+// scenario gets the shared harness's containers reset to the fixture
+// and a fresh cutover server, then runs its own ShardingFerry against them.
+type scenario struct {
+	name string
+
+	// script, if set, configures the stub cutover server before Run.
+	script func(*shardingtest.CutoverServer)
+
+	// run drives the ferry and makes scenario-specific assertions. It
+	// receives the harness and the scripted server so it can inspect
+	// request counts (e.g. retries) after the run.
+	run func(t *testing.T, h *shardingtest.Harness, server *shardingtest.CutoverServer)
+}
+
+var scenarios = []scenario{
+	{
+		name: "happy path",
+		run: func(t *testing.T, h *shardingtest.Harness, server *shardingtest.CutoverServer) {
+			runFerry(t, h, server, baseConfig(h, server))
+			shardingtest.AssertTenantRowsEqual(t, h, "gftest1", "tenant_id", 1)
+		},
+	},
+	{
+		name: "mid-copy container kill resumes from checkpoint",
+		run: func(t *testing.T, h *shardingtest.Harness, server *shardingtest.CutoverServer) {
+			store := sharding.NewJSONFileCheckpointStore(t.TempDir() + "/checkpoint.gob")
+			config := baseConfig(h, server)
+
+			ferry, err := sharding.NewFerry(config, sharding.WithCheckpointStore(store))
+			if err != nil {
+				t.Fatalf("failed to build ferry: %v", err)
+			}
+			interruptMidCopy(t, h, ferry, store)
+
+			resumed, err := sharding.NewFerry(config, sharding.WithCheckpointStore(store))
+			if err != nil {
+				t.Fatalf("failed to build resumed ferry: %v", err)
+			}
+			if err := resumed.Resume(); err != nil {
+				t.Fatalf("failed to resume from checkpoint: %v", err)
+			}
+
+			runToCompletion(t, resumed)
+			shardingtest.AssertTenantRowsEqual(t, h, "gftest1", "tenant_id", 1)
+		},
+	},
+	{
+		name: "lock endpoint returns 503 then 200",
+		script: func(server *shardingtest.CutoverServer) {
+			server.Script("/lock", shardingtest.CutoverResponse{StatusCode: http.StatusServiceUnavailable})
+		},
+		run: func(t *testing.T, h *shardingtest.Harness, server *shardingtest.CutoverServer) {
+			runFerry(t, h, server, baseConfig(h, server))
+
+			if requests := server.Requests("/lock"); len(requests) != 2 {
+				t.Fatalf("expected 2 lock attempts (1 failed + 1 retry), got %d", len(requests))
+			}
+		},
+	},
+	{
+		name: "verifier detects a planted delta",
+		run: func(t *testing.T, h *shardingtest.Harness, server *shardingtest.CutoverServer) {
+			plantDelta(t, h, "gftest1", 1)
+			assertRunFatals(t, h, server, baseConfig(h, server), "verifier detected data discrepancy")
+		},
+	},
+	{
+		name: "joined-table delta larger than DataIterationBatchSize",
+		run: func(t *testing.T, h *shardingtest.Harness, server *shardingtest.CutoverServer) {
+			config := baseConfig(h, server)
+			config.DataIterationBatchSize = 1
+
+			seedJoinedTableRows(t, h, "gftest_joined", 10)
+			runFerry(t, h, server, config)
+			shardingtest.AssertTenantRowsEqual(t, h, "gftest_joined", "tenant_id", 1)
+		},
+	},
+}
+
+func TestCutoverScenarios(t *testing.T) {
+	h := shardingtest.NewHarness(t)
+
+	for _, s := range scenarios {
+		s := s
+		t.Run(s.name, func(t *testing.T) {
+			server := shardingtest.NewCutoverServer(t)
+			if s.script != nil {
+				s.script(server)
+			}
+			resetFixture(t, h)
+			s.run(t, h, server)
+		})
+	}
+}
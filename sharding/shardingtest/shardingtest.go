@@ -0,0 +1,260 @@
+// Package shardingtest provides a reproducible, dockertest-backed
+// integration harness for exercising sharding.ShardingFerry end to end
+// against real MySQL instances and a scriptable HTTP cutover endpoint.
+package shardingtest
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+
+	"github.com/Shopify/ghostferry/sharding"
+)
+
+// Harness provisions a source and target MySQL container; the stub cutover
+// HTTP server is started separately, per scenario, by NewCutoverServer. A
+// single Harness is meant to be reused across the scenarios in a table, so
+// the (slow) container provisioning happens once per test rather than once
+// per scenario.
+type Harness struct {
+	pool *dockertest.Pool
+
+	sourceResource *dockertest.Resource
+	targetResource *dockertest.Resource
+
+	SourceDB *sql.DB
+	TargetDB *sql.DB
+
+	mu sync.Mutex
+}
+
+// NewHarness starts the source and target MySQL containers. It registers a
+// cleanup that tears them down even if the calling test panics, via t.Cleanup.
+func NewHarness(t testingT) *Harness {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		t.Fatalf("failed to connect to docker: %v", err)
+	}
+	pool.MaxWait = 60 * time.Second
+
+	h := &Harness{pool: pool}
+
+	h.sourceResource, h.SourceDB = h.startMySQL(t, "ghostferry_source_test")
+	h.targetResource, h.TargetDB = h.startMySQL(t, "ghostferry_target_test")
+
+	t.Cleanup(func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if h.sourceResource != nil {
+			_ = h.pool.Purge(h.sourceResource)
+		}
+		if h.targetResource != nil {
+			_ = h.pool.Purge(h.targetResource)
+		}
+	})
+
+	return h
+}
+
+func (h *Harness) startMySQL(t testingT, name string) (*dockertest.Resource, *sql.DB) {
+	resource, err := h.pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "mysql",
+		Tag:        "5.7",
+		Name:       name,
+		Env:        []string{"MYSQL_ALLOW_EMPTY_PASSWORD=yes", "MYSQL_DATABASE=gftest"},
+	}, func(hc *docker.HostConfig) {
+		// Not auto-removed: RestartSourceContainer stops and starts the same
+		// container, which Docker would delete on stop. Cleanup purges it.
+		hc.AutoRemove = false
+	})
+	if err != nil {
+		t.Fatalf("failed to start %s: %v", name, err)
+	}
+
+	var db *sql.DB
+	err = h.pool.Retry(func() error {
+		var err error
+		db, err = sql.Open("mysql", fmt.Sprintf("root@(localhost:%s)/gftest", resource.GetPort("3306/tcp")))
+		if err != nil {
+			return err
+		}
+		return db.Ping()
+	})
+	if err != nil {
+		t.Fatalf("%s never became reachable: %v", name, err)
+	}
+
+	return resource, db
+}
+
+// RestartSourceContainer stops and restarts the source MySQL container,
+// simulating a ferry run that is abruptly cut off mid-copy, and blocks
+// until the container is reachable again. It is meant for scenarios that
+// exercise Resume after an interrupted run.
+func (h *Harness) RestartSourceContainer(t testingT) {
+	h.mu.Lock()
+	resource := h.sourceResource
+	h.mu.Unlock()
+
+	if err := h.pool.Client.StopContainer(resource.Container.ID, 10); err != nil {
+		t.Fatalf("failed to stop source container: %v", err)
+	}
+	if err := h.pool.Client.StartContainer(resource.Container.ID, nil); err != nil {
+		t.Fatalf("failed to restart source container: %v", err)
+	}
+
+	if err := h.pool.Retry(func() error { return h.SourceDB.Ping() }); err != nil {
+		t.Fatalf("source container never became reachable again: %v", err)
+	}
+}
+
+// CutoverServer is a stub HTTP server for the app's lock/unlock endpoints,
+// whose behavior per call can be scripted by a test via Script.
+type CutoverServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	scripts  map[string][]CutoverResponse
+	received []CutoverRequest
+}
+
+// CutoverResponse is one scripted response for a single call to /lock or
+// /unlock: either a status code to return, or Hang to never respond (so the
+// caller's request times out / the context deadline fires).
+type CutoverResponse struct {
+	StatusCode int
+	Hang       bool
+}
+
+// CutoverRequest records one call the ferry made to the stub server, so
+// scenarios can assert on retry counts and idempotency keys.
+type CutoverRequest struct {
+	Path           string
+	IdempotencyKey string
+}
+
+// NewCutoverServer starts a stub cutover server with no scripted responses;
+// calls default to 200 OK until Script is used to queue specific responses.
+func NewCutoverServer(t testingT) *CutoverServer {
+	s := &CutoverServer{scripts: map[string][]CutoverResponse{}}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.received = append(s.received, CutoverRequest{
+			Path:           r.URL.Path,
+			IdempotencyKey: r.Header.Get("Idempotency-Key"),
+		})
+
+		queue := s.scripts[r.URL.Path]
+		var next CutoverResponse
+		if len(queue) > 0 {
+			next, queue = queue[0], queue[1:]
+			s.scripts[r.URL.Path] = queue
+		} else {
+			next = CutoverResponse{StatusCode: http.StatusOK}
+		}
+		s.mu.Unlock()
+
+		if next.Hang {
+			<-r.Context().Done()
+			return
+		}
+
+		w.WriteHeader(next.StatusCode)
+		_ = json.NewEncoder(w).Encode(map[string]bool{"ok": next.StatusCode < 300})
+	}))
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Script queues responses to be returned, in order, for calls to path (e.g.
+// "/lock" or "/unlock"). Once the queue is exhausted, calls default to 200.
+func (s *CutoverServer) Script(path string, responses ...CutoverResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[path] = append(s.scripts[path], responses...)
+}
+
+func (s *CutoverServer) Requests(path string) []CutoverRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matched []CutoverRequest
+	for _, r := range s.received {
+		if r.Path == path {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+// AssertTenantRowsEqual fails the test if the rows in table for the given
+// sharding value differ between source and target.
+func AssertTenantRowsEqual(t testingT, h *Harness, table, shardingKey string, shardingValue interface{}) {
+	sourceRows := fetchRows(t, h.SourceDB, table, shardingKey, shardingValue)
+	targetRows := fetchRows(t, h.TargetDB, table, shardingKey, shardingValue)
+
+	if len(sourceRows) != len(targetRows) {
+		t.Fatalf("%s: source has %d rows for %s=%v, target has %d", table, len(sourceRows), shardingKey, shardingValue, len(targetRows))
+	}
+
+	for i := range sourceRows {
+		if sourceRows[i] != targetRows[i] {
+			t.Fatalf("%s: row %d differs for %s=%v: source=%v target=%v", table, i, shardingKey, shardingValue, sourceRows[i], targetRows[i])
+		}
+	}
+}
+
+func fetchRows(t testingT, db *sql.DB, table, shardingKey string, shardingValue interface{}) []string {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s = ? ORDER BY id", table, shardingKey), shardingValue)
+	if err != nil {
+		t.Fatalf("failed to query %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatalf("failed to read columns for %s: %v", table, err)
+	}
+
+	var results []string
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			t.Fatalf("failed to scan row in %s: %v", table, err)
+		}
+		results = append(results, fmt.Sprintf("%v", values))
+	}
+
+	return results
+}
+
+// NewFerry builds a sharding.ShardingFerry from config, ready for
+// Initialize/Start/Run. It passes config through unchanged: it does not
+// point config at the harness's containers or at a cutover server.
+func (h *Harness) NewFerry(config *sharding.Config) (*sharding.ShardingFerry, error) {
+	return sharding.NewFerry(config)
+}
+
+// testingT is the subset of *testing.T this package depends on, so Harness
+// and CutoverServer can be driven from table-driven subtests via t.Run
+// without importing "testing" into the non-_test.go harness file.
+type testingT interface {
+	Fatalf(format string, args ...interface{})
+	Cleanup(func())
+}